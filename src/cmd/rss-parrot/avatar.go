@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"rss_parrot/shared"
+)
+
+const avatarFetchTimeout = 10 * time.Second
+
+// fetchAndStoreAvatar downloads iconUrl, mirrors it into s.blobStore under a
+// content-addressed key, and points the account's ActivityPub actor icon at
+// the mirrored copy via idb.UserAvatar, so remote instances stop depending on
+// an upstream URL that might disappear.
+func fetchAndStoreAvatar(s *state, handle string, accountId int, iconUrl string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), avatarFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, iconUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: unexpected status %s", iconUrl, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 5<<20))
+	if err != nil {
+		return err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	sum := sha256.Sum256(body)
+	key := fmt.Sprintf("avatars/%s/%s", handle, hex.EncodeToString(sum[:]))
+
+	if _, err = s.blobStore.Put(ctx, key, bytes.NewReader(body), contentType); err != nil {
+		return fmt.Errorf("storing avatar for @%s: %w", handle, err)
+	}
+	if err = s.repo.SetAccountAvatar(accountId, key, contentType); err != nil {
+		return err
+	}
+
+	idb := shared.IdBuilder{Host: s.cfg.Host}
+	return s.repo.SetAccountProfileImageUrl(accountId, idb.UserAvatar(handle))
+}
+
+// cmdAvatar re-fetches and re-stores an account's avatar from iconUrl. Meant
+// for operators to push a fresh cached copy when an upstream feed's icon
+// changes or rss-parrot's mirrored copy was never populated at register time
+// (e.g. the feed had no discoverable favicon yet).
+func cmdAvatar(s *state, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: avatar <handle> <icon-url>")
+	}
+	handle, iconUrl := args[0], args[1]
+
+	acct, err := s.repo.GetAccount(handle)
+	if err != nil {
+		return err
+	}
+	if acct == nil {
+		return fmt.Errorf("no such account '%s'", handle)
+	}
+
+	if err = fetchAndStoreAvatar(s, handle, acct.Id, iconUrl); err != nil {
+		return err
+	}
+	fmt.Printf("Stored avatar for @%s from %s\n", handle, iconUrl)
+	return nil
+}
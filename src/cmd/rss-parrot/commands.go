@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"rss_parrot/dal"
+	"rss_parrot/shared"
+)
+
+func cmdRegister(s *state, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: register <feed-url>")
+	}
+	feedUrl := args[0]
+
+	handle, err := handleFromFeedUrl(feedUrl)
+	if err != nil {
+		return err
+	}
+
+	pubKeyPem, privKeyPem, err := generateKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	idb := shared.IdBuilder{Host: s.cfg.Host}
+	acct := &dal.Account{
+		CreatedAt: time.Now(),
+		UserUrl:   idb.UserUrl(handle),
+		Handle:    handle,
+		FeedUrl:   feedUrl,
+		PubKey:    pubKeyPem,
+	}
+	isNew, err := s.repo.AddAccountIfNotExist(acct, privKeyPem)
+	if err != nil {
+		return fmt.Errorf("failed to register account: %w", err)
+	}
+	if !isNew {
+		return fmt.Errorf("an account for '%s' already exists", feedUrl)
+	}
+	fmt.Printf("Registered @%s for %s\n", handle, feedUrl)
+
+	// Mirroring the site's favicon is best-effort: plenty of sites don't
+	// serve one at the conventional path, and a missing avatar shouldn't
+	// fail registration. `rss-parrot avatar` lets an operator push one in
+	// later from wherever the real icon actually lives.
+	if host, hErr := shared.GetHostName(feedUrl); hErr == nil {
+		if stored, sErr := s.repo.GetAccount(handle); sErr == nil && stored != nil {
+			iconUrl := fmt.Sprintf("https://%s/favicon.ico", host)
+			if aErr := fetchAndStoreAvatar(s, handle, stored.Id, iconUrl); aErr != nil {
+				s.logger.Printf("No avatar mirrored for @%s: %v", handle, aErr)
+			}
+		}
+	}
+	return nil
+}
+
+func cmdRotateKey(s *state, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: rotate-key <handle>")
+	}
+	handle := args[0]
+
+	exists, err := s.repo.DoesAccountExist(handle)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no such account '%s'", handle)
+	}
+
+	pubKeyPem, privKeyPem, err := generateKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	if err = s.repo.SetKeyPair(handle, pubKeyPem, privKeyPem); err != nil {
+		return err
+	}
+
+	n, err := queueKeyUpdate(s, handle, pubKeyPem)
+	if err != nil {
+		return fmt.Errorf("key rotated, but failed to queue the Update activity to followers: %w", err)
+	}
+
+	fmt.Printf("Rotated key for @%s; queued an Update activity for %d follower inbox(es)\n", handle, n)
+	return nil
+}
+
+// queueKeyUpdate enqueues an ActivityPub Update activity announcing handle's
+// new public key to every follower's shared inbox, via the same durable
+// toot_queue the delivery worker already drains. Remote instances keep
+// serving the old (possibly compromised) cached key until their inbox
+// actually processes this.
+func queueKeyUpdate(s *state, handle, pubKeyPem string) (int, error) {
+	idb := shared.IdBuilder{Host: s.cfg.Host}
+
+	activity, err := json.Marshal(map[string]any{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"id":       fmt.Sprintf("%s#update-%d", idb.UserUrl(handle), time.Now().Unix()),
+		"type":     "Update",
+		"actor":    idb.UserUrl(handle),
+		"object": map[string]any{
+			"id":   idb.UserUrl(handle),
+			"type": "Person",
+			"publicKey": map[string]any{
+				"id":           idb.UserKeyId(handle),
+				"owner":        idb.UserUrl(handle),
+				"publicKeyPem": pubKeyPem,
+			},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	followers, err := s.repo.GetFollowersByUser(handle)
+	if err != nil {
+		return 0, err
+	}
+
+	seenInbox := map[string]bool{}
+	now := time.Now()
+	n := 0
+	for _, f := range followers {
+		if seenInbox[f.SharedInbox] {
+			continue
+		}
+		seenInbox[f.SharedInbox] = true
+		if err = s.repo.AddTootQueueItem(&dal.TootQueueItem{
+			SendingUser: handle,
+			ToInbox:     f.SharedInbox,
+			TootedAt:    now,
+			Content:     string(activity),
+		}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func cmdFollowers(s *state, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: followers <handle>")
+	}
+	followers, err := s.repo.GetFollowersByUser(args[0])
+	if err != nil {
+		return err
+	}
+	for _, f := range followers {
+		fmt.Printf("%s\t%s\n", f.Handle, f.UserUrl)
+	}
+	fmt.Printf("%d followers\n", len(followers))
+	return nil
+}
+
+func cmdQueue(s *state, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: queue drain|inspect|requeue <id>")
+	}
+	switch args[0] {
+	case "inspect":
+		return queueInspect(s)
+	case "requeue":
+		return queueRequeue(s, args[1:])
+	case "drain":
+		return queueDrain(s)
+	default:
+		return fmt.Errorf("unknown queue subcommand '%s'", args[0])
+	}
+}
+
+func queueInspect(s *state) error {
+	items, err := s.repo.ListTootQueueItems(100)
+	if err != nil {
+		return err
+	}
+	for _, tqi := range items {
+		fmt.Printf("%d\t%s -> %s\tattempts=%d\tnext=%s\tlast_error=%s\n",
+			tqi.Id, tqi.SendingUser, tqi.ToInbox, tqi.Attempts, tqi.NextAttemptAt.Format(time.RFC3339), tqi.LastError)
+	}
+	return nil
+}
+
+func queueRequeue(s *state, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: queue requeue <id>")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid queue item id '%s'", args[0])
+	}
+	return s.repo.RequeueTootQueueItem(id)
+}
+
+// queueDrain forcibly empties the queue without delivering anything. It's
+// meant for decommissioning an instance or a dead recipient, not as a
+// substitute for letting the live delivery worker retry in the background.
+func queueDrain(s *state) error {
+	n, err := s.repo.DrainTootQueue()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Drained %d queued toot(s)\n", n)
+	return nil
+}
+
+func cmdPurge(s *state, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: purge <handle>")
+	}
+	if err := s.repo.DeleteAccountCascade(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Purged @%s\n", args[0])
+	return nil
+}
+
+func cmdMigrate(s *state, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: migrate up|down|status")
+	}
+	switch args[0] {
+	case "up":
+		return s.repo.Migrate(-1)
+	case "down":
+		return s.repo.Migrate(0)
+	case "status":
+		return migrateStatus(s)
+	default:
+		return fmt.Errorf("unknown migrate subcommand '%s'", args[0])
+	}
+}
+
+func migrateStatus(s *state) error {
+	statuses, err := s.repo.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, st := range statuses {
+		applied := "pending"
+		if st.Applied {
+			applied = st.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%d\t%s\t%s\n", st.Version, st.Name, applied)
+	}
+	return nil
+}
+
+func handleFromFeedUrl(feedUrl string) (string, error) {
+	host, err := shared.GetHostName(feedUrl)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive a handle from '%s': %w", feedUrl, err)
+	}
+	return strings.ReplaceAll(host, ".", "-"), nil
+}
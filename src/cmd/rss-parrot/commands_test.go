@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHandleFromFeedUrl(t *testing.T) {
+	cases := []struct {
+		feedUrl string
+		want    string
+		wantErr bool
+	}{
+		{"https://blog.example.com/feed.xml", "blog-example-com", false},
+		{"http://example.com/rss", "example-com", false},
+		{"http://%zz/feed", "", true},
+	}
+	for _, c := range cases {
+		got, err := handleFromFeedUrl(c.feedUrl)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("handleFromFeedUrl(%q): expected an error, got handle %q", c.feedUrl, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("handleFromFeedUrl(%q): unexpected error: %v", c.feedUrl, err)
+		}
+		if got != c.want {
+			t.Errorf("handleFromFeedUrl(%q) = %q, want %q", c.feedUrl, got, c.want)
+		}
+	}
+}
+
+func TestCommandsRunUnknown(t *testing.T) {
+	c := newCommands()
+	if err := c.run(&state{}, "not-a-command", nil); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
+
+func TestCommandsRunDispatchesRegisteredCommand(t *testing.T) {
+	c := &commands{commandMap: map[string]commandFunc{
+		"ping": func(s *state, args []string) error {
+			return fmt.Errorf("called with %v", args)
+		},
+	}}
+	err := c.run(&state{}, "ping", []string{"a", "b"})
+	if err == nil || err.Error() != "called with [a b]" {
+		t.Errorf("expected the registered handler to run with its args, got: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	pubKeyPem, privKeyPem, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair() returned an error: %v", err)
+	}
+
+	pubBlock, _ := pem.Decode([]byte(pubKeyPem))
+	if pubBlock == nil || pubBlock.Type != "PUBLIC KEY" {
+		t.Fatalf("expected a PEM-encoded PUBLIC KEY block, got %+v", pubBlock)
+	}
+	if _, err = x509.ParsePKIXPublicKey(pubBlock.Bytes); err != nil {
+		t.Errorf("failed to parse the generated public key: %v", err)
+	}
+
+	privBlock, _ := pem.Decode([]byte(privKeyPem))
+	if privBlock == nil || privBlock.Type != "RSA PRIVATE KEY" {
+		t.Fatalf("expected a PEM-encoded RSA PRIVATE KEY block, got %+v", privBlock)
+	}
+	if _, err = x509.ParsePKCS1PrivateKey(privBlock.Bytes); err != nil {
+		t.Errorf("failed to parse the generated private key: %v", err)
+	}
+}
+
+func TestGenerateKeyPairIsUnique(t *testing.T) {
+	pub1, _, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair() returned an error: %v", err)
+	}
+	pub2, _, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair() returned an error: %v", err)
+	}
+	if pub1 == pub2 {
+		t.Error("expected two successive calls to generateKeyPair to produce different keys")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"rss_parrot/dal"
+	"rss_parrot/shared"
+	"rss_parrot/shared/blobstore"
+)
+
+// state is threaded through every subcommand: the loaded config, a logger,
+// a repo opened against that config's database, and the blob store account
+// avatars are mirrored into. Subcommands operate directly on the database;
+// they don't start the HTTP server.
+type state struct {
+	cfg       *shared.Config
+	logger    shared.ILogger
+	repo      dal.IRepo
+	blobStore blobstore.IBlobStore
+}
+
+type commandFunc func(s *state, args []string) error
+
+type commands struct {
+	commandMap map[string]commandFunc
+}
+
+func newCommands() *commands {
+	c := &commands{commandMap: map[string]commandFunc{}}
+	c.commandMap["register"] = cmdRegister
+	c.commandMap["rotate-key"] = cmdRotateKey
+	c.commandMap["followers"] = cmdFollowers
+	c.commandMap["queue"] = cmdQueue
+	c.commandMap["purge"] = cmdPurge
+	c.commandMap["migrate"] = cmdMigrate
+	c.commandMap["avatar"] = cmdAvatar
+	return c
+}
+
+func (c *commands) run(s *state, name string, args []string) error {
+	fn, ok := c.commandMap[name]
+	if !ok {
+		return fmt.Errorf("unknown command '%s'", name)
+	}
+	return fn(s, args)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: rss-parrot <command> [args...]")
+		os.Exit(1)
+	}
+
+	cfg := shared.LoadConfig()
+	logger := shared.NewLogger(cfg)
+	repo := dal.NewRepo(cfg, logger)
+
+	// The migrate subcommand drives the schema version itself (up/down/status);
+	// auto-migrating here first would mean `migrate status` never reports
+	// anything pending and `migrate down` immediately reverts what it was
+	// asked to inspect.
+	if os.Args[1] != "migrate" {
+		repo.InitUpdateDb()
+	}
+
+	blobStore, err := blobstore.New(context.Background(), &cfg.BlobStore)
+	if err != nil {
+		logger.Errorf("Failed to initialize blob store (%s): %v", cfg.BlobStore.Type, err)
+		os.Exit(1)
+	}
+
+	s := &state{cfg: cfg, logger: logger, repo: repo, blobStore: blobStore}
+
+	if err := newCommands().run(s, os.Args[1], os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "rss-parrot %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
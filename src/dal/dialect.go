@@ -0,0 +1,41 @@
+package dal
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+
+	"rss_parrot/shared"
+)
+
+// dialect isolates the handful of ways the supported database engines differ:
+// how to open a connection, where the embedded schema scripts for that engine
+// live, how `?` placeholders need to be rewritten, and how to recognise a
+// duplicate-key error. Each engine registers its dialect from an init() in
+// its own driver_*.go file. Only the sqlite3 driver (which needs cgo) can be
+// left out of a build, via the nosqlite build tag; the postgres and mysql
+// drivers are always compiled in.
+type dialect struct {
+	name           string
+	open           func(cfg *shared.DatabaseCfg) (*sql.DB, error)
+	scripts        embed.FS
+	scriptsDir     string
+	rewrite        func(query string) string
+	isDuplicateKey func(err error) bool
+}
+
+var dialects = map[string]*dialect{}
+
+func registerDialect(d *dialect) {
+	dialects[d.name] = d
+}
+
+func dialectFor(dbType string) (*dialect, error) {
+	d, ok := dialects[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type '%s'", dbType)
+	}
+	return d, nil
+}
+
+func identityRewrite(query string) string { return query }
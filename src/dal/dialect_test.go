@@ -0,0 +1,28 @@
+package dal
+
+import "testing"
+
+func TestDialectForUnknownType(t *testing.T) {
+	if _, err := dialectFor("not-a-real-database"); err == nil {
+		t.Error("expected an error for an unregistered database type")
+	}
+}
+
+func TestDialectForRegistered(t *testing.T) {
+	for name := range dialects {
+		d, err := dialectFor(name)
+		if err != nil {
+			t.Errorf("dialectFor(%q) returned an error: %v", name, err)
+		}
+		if d.name != name {
+			t.Errorf("dialectFor(%q).name = %q, want %q", name, d.name, name)
+		}
+	}
+}
+
+func TestIdentityRewrite(t *testing.T) {
+	const q = "SELECT * FROM accounts WHERE handle=?"
+	if got := identityRewrite(q); got != q {
+		t.Errorf("identityRewrite(%q) = %q, want unchanged", q, got)
+	}
+}
@@ -0,0 +1,38 @@
+package dal
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"rss_parrot/shared"
+)
+
+//go:embed scripts/mysql/*.sql
+var mysqlScripts embed.FS
+
+func init() {
+	registerDialect(&dialect{
+		name:           "mysql",
+		open:           openMysql,
+		scripts:        mysqlScripts,
+		scriptsDir:     "scripts/mysql",
+		rewrite:        identityRewrite,
+		isDuplicateKey: isMysqlDuplicateKey,
+	})
+}
+
+func openMysql(cfg *shared.DatabaseCfg) (*sql.DB, error) {
+	// multiStatements is required because the embedded create-NN.sql scripts
+	// (and execRawSqlStep, which runs them) each send a whole file as a
+	// single multi-statement Exec.
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&multiStatements=true",
+		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
+	return sql.Open("mysql", dsn)
+}
+
+func isMysqlDuplicateKey(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
+}
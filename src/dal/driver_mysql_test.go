@@ -0,0 +1,20 @@
+package dal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsMysqlDuplicateKey(t *testing.T) {
+	if isMysqlDuplicateKey(errors.New("boom")) {
+		t.Error("expected a plain error not to be treated as a duplicate key")
+	}
+	if !isMysqlDuplicateKey(&mysql.MySQLError{Number: 1062}) {
+		t.Error("expected MySQLError 1062 to be treated as a duplicate key")
+	}
+	if isMysqlDuplicateKey(&mysql.MySQLError{Number: 1045}) {
+		t.Error("expected a non-1062 MySQLError not to be treated as a duplicate key")
+	}
+}
@@ -0,0 +1,64 @@
+package dal
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"rss_parrot/shared"
+)
+
+//go:embed scripts/postgres/*.sql
+var postgresScripts embed.FS
+
+func init() {
+	registerDialect(&dialect{
+		name:           "postgres",
+		open:           openPostgres,
+		scripts:        postgresScripts,
+		scriptsDir:     "scripts/postgres",
+		rewrite:        rewritePostgresPlaceholders,
+		isDuplicateKey: isPostgresDuplicateKey,
+	})
+}
+
+func openPostgres(cfg *shared.DatabaseCfg) (*sql.DB, error) {
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Database)
+	return sql.Open("postgres", dsn)
+}
+
+// rewritePostgresPlaceholders turns the `?` placeholders used throughout dal
+// into postgres's positional `$1`, `$2`, ... form, leaving any literal `?`
+// inside a single-quoted string (e.g. a LIKE pattern) untouched. A doubled
+// `''` escaping a quote within a string toggles inString twice in a row,
+// landing back where it started, so it's handled correctly without special
+// casing.
+func rewritePostgresPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		if r == '\'' {
+			inString = !inString
+			b.WriteRune(r)
+			continue
+		}
+		if r == '?' && !inString {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isPostgresDuplicateKey(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
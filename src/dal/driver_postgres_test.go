@@ -0,0 +1,44 @@
+package dal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestRewritePostgresPlaceholders(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM accounts WHERE handle=?", "SELECT * FROM accounts WHERE handle=$1"},
+		{"UPDATE accounts SET pubkey=?, privkey=? WHERE handle=?",
+			"UPDATE accounts SET pubkey=$1, privkey=$2 WHERE handle=$3"},
+		{"SELECT * FROM accounts WHERE name LIKE '%?%'", "SELECT * FROM accounts WHERE name LIKE '%?%'"},
+		{"SELECT * FROM accounts WHERE name LIKE '%?%' AND handle=?",
+			"SELECT * FROM accounts WHERE name LIKE '%?%' AND handle=$1"},
+		{"SELECT * FROM accounts WHERE summary='it''s a ? test' AND handle=?",
+			"SELECT * FROM accounts WHERE summary='it''s a ? test' AND handle=$1"},
+	}
+	for _, c := range cases {
+		if got := rewritePostgresPlaceholders(c.query); got != c.want {
+			t.Errorf("rewritePostgresPlaceholders(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestIsPostgresDuplicateKey(t *testing.T) {
+	if isPostgresDuplicateKey(errors.New("boom")) {
+		t.Error("expected a plain error not to be treated as a duplicate key")
+	}
+	dup := &pq.Error{Code: "23505"}
+	if !isPostgresDuplicateKey(dup) {
+		t.Error("expected pq.Error with code 23505 to be treated as a duplicate key")
+	}
+	other := &pq.Error{Code: "42601"}
+	if isPostgresDuplicateKey(other) {
+		t.Error("expected pq.Error with a non-23505 code not to be treated as a duplicate key")
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !nosqlite
+
+package dal
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+	"rss_parrot/shared"
+)
+
+//go:embed scripts/sqlite/*.sql
+var sqliteScripts embed.FS
+
+func init() {
+	registerDialect(&dialect{
+		name:           "sqlite3",
+		open:           openSqlite,
+		scripts:        sqliteScripts,
+		scriptsDir:     "scripts/sqlite",
+		rewrite:        identityRewrite,
+		isDuplicateKey: isSqliteDuplicateKey,
+	})
+}
+
+func openSqlite(cfg *shared.DatabaseCfg) (*sql.DB, error) {
+	// _busy_timeout makes concurrent callers (e.g. several
+	// LeaseTootQueueItems calls racing to UPDATE the same rows) block and
+	// retry instead of immediately failing with "database is locked".
+	// cache=shared is deliberately omitted: combined with database/sql's
+	// own connection pool it produces SQLITE_LOCKED table-lock conflicts
+	// between connections in the same process that _busy_timeout can't
+	// retry its way out of.
+	return sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&_busy_timeout=5000", cfg.FileName))
+}
+
+// isSqliteDuplicateKey treats both SQLITE_CONSTRAINT_UNIQUE and
+// SQLITE_CONSTRAINT_PRIMARYKEY as a duplicate key: a TEXT/non-integer PRIMARY
+// KEY column (e.g. instance_health.host) raises the latter, not the former,
+// even though it's the same kind of conflict postgres's 23505 and mysql's
+// 1062 both cover uniformly.
+func isSqliteDuplicateKey(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok {
+		return false
+	}
+	return sqliteErr.Code == 19 && (sqliteErr.ExtendedCode == 2067 || sqliteErr.ExtendedCode == 1555)
+}
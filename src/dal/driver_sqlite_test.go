@@ -0,0 +1,28 @@
+//go:build !nosqlite
+
+package dal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestIsSqliteDuplicateKey(t *testing.T) {
+	if isSqliteDuplicateKey(errors.New("boom")) {
+		t.Error("expected a plain error not to be treated as a duplicate key")
+	}
+	dup := sqlite3.Error{Code: 19, ExtendedCode: 2067}
+	if !isSqliteDuplicateKey(dup) {
+		t.Error("expected sqlite3.Error{19, 2067} (UNIQUE) to be treated as a duplicate key")
+	}
+	dupPk := sqlite3.Error{Code: 19, ExtendedCode: 1555}
+	if !isSqliteDuplicateKey(dupPk) {
+		t.Error("expected sqlite3.Error{19, 1555} (PRIMARY KEY) to be treated as a duplicate key")
+	}
+	other := sqlite3.Error{Code: 19, ExtendedCode: 1299}
+	if isSqliteDuplicateKey(other) {
+		t.Error("expected a different extended code not to be treated as a duplicate key")
+	}
+}
@@ -0,0 +1,300 @@
+package dal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"rss_parrot/shared"
+)
+
+// Migration is one forward (and optionally backward) schema step. Up/Down
+// each run inside their own transaction. SQL-file migrations are generated
+// from the create-NN.sql scripts embedded by the active dialect; Go
+// migrations (e.g. seeding built-in data) set Up/Down directly.
+type Migration struct {
+	Version  int
+	Name     string
+	Checksum string
+	Up       func(tx *sql.Tx) error
+	Down     func(tx *sql.Tx) error
+}
+
+// MigrationStatus reports whether a known migration has been applied, for
+// the `rss-parrot migrate status` command.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+const createMigrationsTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	checksum   TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`
+
+// Migrate brings the database to exactly the given version: it applies Up
+// migrations when target is above the current version, and Down migrations
+// when target is below it. target=-1 means "the latest version known to
+// this binary". Refuses to run if a previously-applied migration's checksum
+// no longer matches what's embedded in the binary.
+func (repo *Repo) Migrate(target int) error {
+
+	if _, err := repo.db.Exec(createMigrationsTableSQL); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	migrations := repo.migrations()
+	if len(migrations) == 0 {
+		return nil
+	}
+	if target < 0 {
+		target = migrations[len(migrations)-1].Version
+	}
+
+	applied, err := repo.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if a, ok := applied[m.Version]; ok && a.Checksum != m.Checksum {
+			return fmt.Errorf("migration %d (%s) has changed since it was applied (checksum mismatch)",
+				m.Version, m.Name)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err = repo.applyUp(m); err != nil {
+			return err
+		}
+	}
+
+	// Check every step we'd need to revert has a Down *before* applying any
+	// of them: otherwise we'd revert the later, easy-to-undo steps and only
+	// then discover an earlier one can't be undone, leaving the database
+	// half-reverted with no way back.
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %d (%s) cannot be reverted: no Down step; refusing to revert any migration above target %d",
+				m.Version, m.Name, target)
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if err = repo.applyDown(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrationStatus lists every migration known to this binary alongside
+// whether (and when) it has been applied to the connected database.
+func (repo *Repo) MigrationStatus() ([]MigrationStatus, error) {
+	if _, err := repo.db.Exec(createMigrationsTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	applied, err := repo.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]MigrationStatus, 0, len(repo.migrations()))
+	for _, m := range repo.migrations() {
+		a, ok := applied[m.Version]
+		res = append(res, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: a.AppliedAt,
+		})
+	}
+	return res, nil
+}
+
+type appliedMigration struct {
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func (repo *Repo) appliedMigrations() (map[int]appliedMigration, error) {
+	rows, err := repo.query("SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[int]appliedMigration{}
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		if err = rows.Scan(&version, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		res[version] = a
+	}
+	return res, rows.Err()
+}
+
+func (repo *Repo) applyUp(m Migration) error {
+	repo.logger.Printf("Applying migration %d: %s", m.Version, m.Name)
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = m.Up(tx); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	_, err = tx.Exec(repo.dialect.rewrite(
+		"INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES(?, ?, ?, ?)"),
+		m.Version, m.Name, m.Checksum, time.Now())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *Repo) applyDown(m Migration) error {
+	repo.logger.Printf("Reverting migration %d: %s", m.Version, m.Name)
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = m.Down(tx); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	_, err = tx.Exec(repo.dialect.rewrite("DELETE FROM schema_migrations WHERE version=?"), m.Version)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrations returns every migration known to this binary, in order: one
+// per embedded create-NN.sql script, followed by the Go migration that
+// seeds the built-in account. Built fresh each call so it always reflects
+// the connected dialect.
+func (repo *Repo) migrations() []Migration {
+	res := repo.sqlFileMigrations()
+
+	seedVersion := 1
+	if len(res) > 0 {
+		seedVersion = res[len(res)-1].Version + 1
+	}
+	res = append(res, Migration{
+		Version:  seedVersion,
+		Name:     "seed built-in user",
+		Checksum: "go:seed-built-in-user",
+		Up: func(tx *sql.Tx) error {
+			return repo.seedBuiltInUserTx(tx)
+		},
+		Down: func(tx *sql.Tx) error {
+			_, err := tx.Exec(repo.dialect.rewrite("DELETE FROM accounts WHERE handle=?"), repo.cfg.Birb.User)
+			return err
+		},
+	})
+	return res
+}
+
+// sqlFileMigrations builds one Migration per embedded create-NN.sql script,
+// in version order. A create-NN.sql is paired with a down-NN.sql in the same
+// directory when one exists, giving that migration a working Down step;
+// create-NN.sql scripts shipped without a matching down-NN.sql stay
+// Down-less, which Migrate refuses to revert past rather than silently
+// losing data.
+func (repo *Repo) sqlFileMigrations() []Migration {
+	entries, err := repo.dialect.scripts.ReadDir(repo.dialect.scriptsDir)
+	if err != nil {
+		repo.logger.Errorf("Failed to list migration scripts in %s: %v", repo.dialect.scriptsDir, err)
+		panic(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "create-") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	res := make([]Migration, 0, len(names))
+	for i, name := range names {
+		sqlStr := repo.readScript(name)
+		sum := sha256.Sum256([]byte(sqlStr))
+
+		m := Migration{
+			Version:  i + 1,
+			Name:     name,
+			Checksum: hex.EncodeToString(sum[:]),
+			Up:       execRawSqlStep(sqlStr),
+		}
+
+		downName := "down-" + strings.TrimPrefix(name, "create-")
+		if downFn := path.Join(repo.dialect.scriptsDir, downName); fileExists(repo.dialect.scripts, downFn) {
+			m.Down = execRawSqlStep(repo.readScript(downName))
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func (repo *Repo) readScript(name string) string {
+	fn := path.Join(repo.dialect.scriptsDir, name)
+	sqlBytes, err := repo.dialect.scripts.ReadFile(fn)
+	if err != nil {
+		repo.logger.Errorf("Failed to read migration script %s: %v", fn, err)
+		panic(err)
+	}
+	return string(sqlBytes)
+}
+
+func fileExists(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
+
+func execRawSqlStep(sqlStr string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(sqlStr)
+		return err
+	}
+}
+
+func (repo *Repo) seedBuiltInUserTx(tx *sql.Tx) error {
+	idb := shared.IdBuilder{Host: repo.cfg.Host}
+	_, err := tx.Exec(repo.dialect.rewrite(`INSERT INTO accounts
+    	(created_at, user_url, handle, pubkey, privkey)
+		VALUES(?, ?, ?, ?, ?)`),
+		repo.cfg.Birb.Published, idb.UserUrl(repo.cfg.Birb.User),
+		repo.cfg.Birb.User, repo.cfg.Birb.PubKey, repo.cfg.Birb.PrivKey)
+	return err
+}
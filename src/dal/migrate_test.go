@@ -0,0 +1,139 @@
+//go:build !nosqlite
+
+package dal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rss_parrot/shared"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(format string, args ...any) { l.t.Logf(format, args...) }
+func (l testLogger) Errorf(format string, args ...any) { l.t.Logf(format, args...) }
+
+func newTestRepo(t *testing.T) *Repo {
+	t.Helper()
+	cfg := &shared.Config{
+		Host: "test.example",
+		Database: shared.DatabaseCfg{
+			Type:     "sqlite3",
+			FileName: filepath.Join(t.TempDir(), "rss-parrot-test.db"),
+		},
+		Birb: shared.BirbCfg{
+			User:      "birb",
+			PubKey:    "test-pubkey",
+			PrivKey:   "test-privkey",
+			Published: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	repoIface := NewRepo(cfg, testLogger{t})
+	return repoIface.(*Repo)
+}
+
+func TestMigrateUpAppliesEveryMigrationAndSeedsBuiltInUser(t *testing.T) {
+	repo := newTestRepo(t)
+
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("Migrate(-1) failed: %v", err)
+	}
+
+	statuses, err := repo.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	if len(statuses) == 0 {
+		t.Fatal("expected at least one known migration")
+	}
+	for _, st := range statuses {
+		if !st.Applied {
+			t.Errorf("migration %d (%s) was not applied", st.Version, st.Name)
+		}
+	}
+
+	if !accountExists(t, repo, repo.cfg.Birb.User) {
+		t.Fatal("expected the built-in user to be seeded by the seed migration")
+	}
+}
+
+func TestMigrateUpIsIdempotent(t *testing.T) {
+	repo := newTestRepo(t)
+
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("first Migrate(-1) failed: %v", err)
+	}
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("second Migrate(-1) should be a no-op, got: %v", err)
+	}
+}
+
+func TestMigrateChecksumMismatchRefusesToRun(t *testing.T) {
+	repo := newTestRepo(t)
+
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("Migrate(-1) failed: %v", err)
+	}
+	if _, err := repo.db.Exec(
+		`UPDATE schema_migrations SET checksum='tampered' WHERE version=1`); err != nil {
+		t.Fatalf("failed to tamper with schema_migrations: %v", err)
+	}
+
+	if err := repo.Migrate(-1); err == nil {
+		t.Error("expected Migrate to refuse to run after a checksum mismatch")
+	}
+}
+
+func TestMigrateDownRevertsEverything(t *testing.T) {
+	repo := newTestRepo(t)
+
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("Migrate(-1) failed: %v", err)
+	}
+	if err := repo.Migrate(0); err != nil {
+		t.Fatalf("Migrate(0) should fully revert now that every migration ships a Down step: %v", err)
+	}
+
+	statuses, err := repo.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	for _, st := range statuses {
+		if st.Applied {
+			t.Errorf("migration %d (%s) still applied after reverting to target 0", st.Version, st.Name)
+		}
+	}
+
+	if _, err = repo.db.Exec("SELECT 1 FROM accounts"); err == nil {
+		t.Error("expected the accounts table to have been dropped by migrate down")
+	}
+}
+
+func TestMigrateDownThenUpRoundTrips(t *testing.T) {
+	repo := newTestRepo(t)
+
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("Migrate(-1) failed: %v", err)
+	}
+	if err := repo.Migrate(0); err != nil {
+		t.Fatalf("Migrate(0) failed: %v", err)
+	}
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("re-running Migrate(-1) after a full revert failed: %v", err)
+	}
+
+	if !accountExists(t, repo, repo.cfg.Birb.User) {
+		t.Fatal("expected the built-in user to be re-seeded after migrating back up")
+	}
+}
+
+func accountExists(t *testing.T, repo *Repo, handle string) bool {
+	t.Helper()
+	var count int
+	if err := repo.db.QueryRow(`SELECT COUNT(*) FROM accounts WHERE handle=?`, handle).Scan(&count); err != nil {
+		t.Fatalf("failed to check for account %q: %v", handle, err)
+	}
+	return count != 0
+}
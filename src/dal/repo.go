@@ -2,29 +2,30 @@ package dal
 
 import (
 	"database/sql"
-	"embed"
 	"errors"
-	"fmt"
-	"github.com/mattn/go-sqlite3"
 	"rss_parrot/shared"
 	"sync"
 	"time"
 )
 
-const schemaVer = 1
-
-//go:embed scripts/*
-var scripts embed.FS
-
 type IRepo interface {
 	InitUpdateDb()
+	Migrate(target int) error
+	MigrationStatus() ([]MigrationStatus, error)
 	GetNextId() uint64
 	AddAccountIfNotExist(account *Account, privKey string) (isNew bool, err error)
 	DoesAccountExist(user string) (bool, error)
 	GetPrivKey(user string) (string, error)
 	GetAccount(user string) (*Account, error)
+	SetPrivKey(user, privKey string) error
+	SetKeyPair(user, pubKey, privKey string) error
+	SetAccountAvatar(accountId int, key, contentType string) error
+	SetAccountProfileImageUrl(accountId int, url string) error
+	ListAccounts() ([]*Account, error)
+	DeleteAccountCascade(handle string) error
 	GetTootCount(user string) (uint, error)
 	AddToot(accountId int, toot *Toot) error
+	GetToot(user string, id int) (*Toot, error)
 	GetFeedLastUpdated(accountId int) (time.Time, error)
 	UpdateAccountFeedTimes(accountId int, lastUpdated, nextCheckDue time.Time) error
 	AddFeedPostIfNew(accountId int, post *FeedPost) (isNew bool, err error)
@@ -35,39 +36,66 @@ type IRepo interface {
 	AddFollower(user string, follower *MastodonUserInfo) error
 	RemoveFollower(user, followerUserUrl string) error
 	AddTootQueueItem(tqi *TootQueueItem) error
-	GetTootQueueItems(aboveId, maxCount int) ([]*TootQueueItem, error)
-	DeleteTootQueueItem(id int) error
+	LeaseTootQueueItems(now time.Time, maxCount int) ([]*TootQueueItem, error)
+	ListTootQueueItems(maxCount int) ([]*TootQueueItem, error)
+	RequeueTootQueueItem(id int) error
+	MarkTootDeliveryOk(id int) error
+	MarkTootDeliveryFailed(id int, deliveryErr error) error
+	DrainTootQueue() (int64, error)
+	RecordInstanceSuccess(host string) error
+	GetInstanceHealth(host string) (*InstanceHealth, error)
 }
 
 type Repo struct {
-	cfg    *shared.Config
-	logger shared.ILogger
-	db     *sql.DB
-	muId   sync.Mutex
-	nextId uint64
+	cfg     *shared.Config
+	logger  shared.ILogger
+	db      *sql.DB
+	dialect *dialect
+	muId    sync.Mutex
+	nextId  uint64
 }
 
 func NewRepo(cfg *shared.Config, logger shared.ILogger) IRepo {
 
-	var err error
-	var db *sql.DB
+	d, err := dialectFor(cfg.Database.Type)
+	if err != nil {
+		logger.Errorf("%v", err)
+		panic(err)
+	}
 
-	db, err = sql.Open("sqlite3", fmt.Sprintf("file:%s??cache=shared&mode=rwc", cfg.DbFile))
+	db, err := d.open(&cfg.Database)
 	if err != nil {
-		logger.Errorf("Failed to open/create DB file: %s: %v", cfg.DbFile, err)
+		logger.Errorf("Failed to open/create database (%s): %v", cfg.Database.Type, err)
 		panic(err)
 	}
 
 	repo := Repo{
-		cfg:    cfg,
-		logger: logger,
-		db:     db,
-		nextId: uint64(time.Now().UnixNano()),
+		cfg:     cfg,
+		logger:  logger,
+		db:      db,
+		dialect: d,
+		nextId:  uint64(time.Now().UnixNano()),
 	}
 
 	return &repo
 }
 
+// exec and query/queryRow below rewrite the `?`-style placeholders used
+// throughout dal into whatever form the active dialect needs (e.g. postgres's
+// `$1`, `$2`, ...) before delegating to the underlying *sql.DB.
+
+func (repo *Repo) exec(query string, args ...any) (sql.Result, error) {
+	return repo.db.Exec(repo.dialect.rewrite(query), args...)
+}
+
+func (repo *Repo) query(query string, args ...any) (*sql.Rows, error) {
+	return repo.db.Query(repo.dialect.rewrite(query), args...)
+}
+
+func (repo *Repo) queryRow(query string, args ...any) *sql.Row {
+	return repo.db.QueryRow(repo.dialect.rewrite(query), args...)
+}
+
 func (repo *Repo) GetNextId() uint64 {
 	repo.muId.Lock()
 	res := repo.nextId + 1
@@ -77,80 +105,15 @@ func (repo *Repo) GetNextId() uint64 {
 }
 
 func (repo *Repo) InitUpdateDb() {
-
-	dbVer := 0
-	sysParamsExists := false
-	var err error
-	var rows *sql.Rows
-
-	rows, err = repo.db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='sys_params'")
-	if err != nil {
-		repo.logger.Errorf("Failed to check if 'sys_params' table exists: %v", err)
-		panic(err)
-	}
-	for rows.Next() {
-		sysParamsExists = true
-	}
-	_ = rows.Close()
-	if !sysParamsExists {
-		repo.logger.Printf("Database appears to be empty; current schema version is %d", schemaVer)
-	} else {
-		row := repo.db.QueryRow("SELECT val FROM sys_params WHERE name='schema_ver'")
-		if err = row.Scan(&dbVer); err != nil {
-			repo.logger.Errorf("Failed to query schema version: %v", err)
-			panic(err)
-		}
-		repo.logger.Printf("Database is at version %d; current schema version is %d", dbVer, schemaVer)
-	}
-	for i := dbVer; i < schemaVer; i += 1 {
-		nextVer := i + 1
-		fn := fmt.Sprintf("scripts/create-%02d.sql", nextVer)
-		repo.logger.Printf("Running %s", fn)
-		var sqlBytes []byte
-		if sqlBytes, err = scripts.ReadFile(fn); err != nil {
-			repo.logger.Errorf("Failed to read init script %s: %v", fn, err)
-			panic(err)
-		}
-		sqlStr := string(sqlBytes)
-		if _, err = repo.db.Exec(sqlStr); err != nil {
-			repo.logger.Errorf("Failed to execute init script %s: %v", fn, err)
-			panic(err)
-		}
-		_, err = repo.db.Exec("UPDATE sys_params SET val=? WHERE name='schema_ver'", nextVer)
-		if err != nil {
-			repo.logger.Errorf("Failed to update schema_ver to %d: %v", i, err)
-			panic(err)
-		}
-	}
-
-	if dbVer == 0 {
-		repo.mustAddBuiltInUsers()
-	}
-
-	// DBG
-	_, _ = repo.AddAccountIfNotExist(&Account{Handle: "handle"}, "xyz")
-	_, _ = repo.AddAccountIfNotExist(&Account{Handle: "handle"}, "xyz")
-}
-
-func (repo *Repo) mustAddBuiltInUsers() {
-
-	idb := shared.IdBuilder{Host: repo.cfg.Host}
-
-	_, err := repo.db.Exec(`INSERT INTO accounts
-    	(created_at, user_url, handle, pubkey, privkey)
-		VALUES(?, ?, ?, ?, ?)`,
-		repo.cfg.Birb.Published, idb.UserUrl(repo.cfg.Birb.User),
-		repo.cfg.Birb.User, repo.cfg.Birb.PubKey, repo.cfg.Birb.PrivKey)
-
-	if err != nil {
-		repo.logger.Errorf("Failed to add built-in user '%s': %v", repo.cfg.Birb.User, err)
+	if err := repo.Migrate(-1); err != nil {
+		repo.logger.Errorf("Failed to migrate database: %v", err)
 		panic(err)
 	}
 }
 
 func (repo *Repo) AddAccountIfNotExist(acct *Account, privKey string) (isNew bool, err error) {
 	isNew = true
-	_, err = repo.db.Exec(`INSERT INTO accounts
+	_, err = repo.exec(`INSERT INTO accounts
     	(created_at, user_url, handle, name, summary, profile_image_url, site_url, feed_url, pubkey, privkey)
 		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		acct.CreatedAt, acct.UserUrl, acct.Handle, acct.Name, acct.Summary, acct.ProfileImageUrl,
@@ -158,20 +121,17 @@ func (repo *Repo) AddAccountIfNotExist(acct *Account, privKey string) (isNew boo
 	if err == nil {
 		return
 	}
-	// MySQL: mysql.MySQLError; mysqlErr.Number == 1062
-	if sqliteErr, ok := err.(sqlite3.Error); ok {
-		// Duplicate key: account with this handle already exists
-		if sqliteErr.Code == 19 && sqliteErr.ExtendedCode == 2067 {
-			isNew = false
-			_, err = repo.GetAccount(acct.Handle)
-			return
-		}
+	// Duplicate key: account with this handle already exists
+	if repo.dialect.isDuplicateKey(err) {
+		isNew = false
+		_, err = repo.GetAccount(acct.Handle)
+		return
 	}
 	return
 }
 
 func (repo *Repo) DoesAccountExist(user string) (bool, error) {
-	row := repo.db.QueryRow(`SELECT COUNT(*) FROM accounts WHERE handle=?`, user)
+	row := repo.queryRow(`SELECT COUNT(*) FROM accounts WHERE handle=?`, user)
 	var err error
 	var count int
 	if err = row.Scan(&count); err != nil {
@@ -181,7 +141,7 @@ func (repo *Repo) DoesAccountExist(user string) (bool, error) {
 }
 
 func (repo *Repo) GetAccount(user string) (*Account, error) {
-	row := repo.db.QueryRow(
+	row := repo.queryRow(
 		`SELECT id, created_at, user_url, handle, name, summary, profile_image_url, site_url, feed_url,
          		feed_last_updated, next_check_due, pubkey
 		FROM accounts WHERE handle=?`, user)
@@ -200,7 +160,7 @@ func (repo *Repo) GetAccount(user string) (*Account, error) {
 }
 
 func (repo *Repo) GetPrivKey(user string) (string, error) {
-	row := repo.db.QueryRow(`SELECT privkey FROM accounts WHERE handle=?`, user)
+	row := repo.queryRow(`SELECT privkey FROM accounts WHERE handle=?`, user)
 	var err error
 	var res string
 	err = row.Scan(&res)
@@ -215,15 +175,98 @@ func (repo *Repo) GetPrivKey(user string) (string, error) {
 }
 
 func (repo *Repo) SetPrivKey(user, privKey string) error {
-	_, err := repo.db.Exec("UPDATE accounts SET privkey=? WHERE handle=?", privKey, user)
+	_, err := repo.exec("UPDATE accounts SET privkey=? WHERE handle=?", privKey, user)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetKeyPair replaces both halves of an account's signing key at once, so
+// the stored pubkey never drifts out of sync with privkey (rotate-key needs
+// this; SetPrivKey alone would leave the old pubkey on file).
+func (repo *Repo) SetKeyPair(user, pubKey, privKey string) error {
+	_, err := repo.exec("UPDATE accounts SET pubkey=?, privkey=? WHERE handle=?", pubKey, privKey, user)
+	return err
+}
+
+// SetAccountAvatar records where an account's avatar blob lives after its
+// upstream icon has been fetched once, hashed, and stored in the configured
+// blob store under key (the rss-parrot register and avatar commands do this).
+func (repo *Repo) SetAccountAvatar(accountId int, key, contentType string) error {
+	_, err := repo.exec("UPDATE accounts SET avatar_key=?, avatar_content_type=? WHERE id=?",
+		key, contentType, accountId)
+	return err
+}
+
+// SetAccountProfileImageUrl points an account's ActivityPub actor icon at a
+// URL rss-parrot controls, once its avatar has been mirrored into the blob
+// store via SetAccountAvatar.
+func (repo *Repo) SetAccountProfileImageUrl(accountId int, url string) error {
+	_, err := repo.exec("UPDATE accounts SET profile_image_url=? WHERE id=?", url, accountId)
+	return err
+}
+
+func (repo *Repo) ListAccounts() ([]*Account, error) {
+	rows, err := repo.query(`SELECT id, created_at, user_url, handle, name, summary, profile_image_url,
+		site_url, feed_url, feed_last_updated, next_check_due, pubkey FROM accounts ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*Account, 0)
+	for rows.Next() {
+		a := Account{}
+		if err = rows.Scan(&a.Id, &a.CreatedAt, &a.UserUrl, &a.Handle, &a.Name, &a.Summary,
+			&a.ProfileImageUrl, &a.SiteUrl, &a.FeedUrl, &a.FeedLastUpdated, &a.NextCheckDue, &a.PubKey); err != nil {
+			return nil, err
+		}
+		res = append(res, &a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteAccountCascade removes an account together with its toots, followers,
+// feed posts, and any still-queued outgoing toots. Rows already moved to
+// toot_dead_letter for the account are kept.
+func (repo *Repo) DeleteAccountCascade(handle string) error {
+	row := repo.queryRow(`SELECT id FROM accounts WHERE handle=?`, handle)
+	var accountId int
+	if err := row.Scan(&accountId); err != nil {
+		return err
+	}
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	cascadeStmts := []string{
+		`DELETE FROM toots WHERE account_id=?`,
+		`DELETE FROM followers WHERE account_id=?`,
+		`DELETE FROM feed_posts WHERE account_id=?`,
+	}
+	for _, stmt := range cascadeStmts {
+		if _, err = tx.Exec(repo.dialect.rewrite(stmt), accountId); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec(repo.dialect.rewrite(`DELETE FROM toot_queue WHERE sending_user=?`), handle); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(repo.dialect.rewrite(`DELETE FROM accounts WHERE id=?`), accountId); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func (repo *Repo) GetTootCount(user string) (uint, error) {
-	row := repo.db.QueryRow(`SELECT COUNT(*) FROM toots JOIN accounts
+	row := repo.queryRow(`SELECT COUNT(*) FROM toots JOIN accounts
 		ON toots.account_id=accounts.id AND accounts.handle=?`, user)
 	var err error
 	var count int
@@ -234,7 +277,7 @@ func (repo *Repo) GetTootCount(user string) (uint, error) {
 }
 
 func (repo *Repo) AddToot(accountId int, toot *Toot) error {
-	_, err := repo.db.Exec(`INSERT INTO toots (account_id, post_guid_hash, tooted_at, status_id, content)
+	_, err := repo.exec(`INSERT INTO toots (account_id, post_guid_hash, tooted_at, status_id, content)
 		VALUES(?, ?, ?, ?, ?)`,
 		accountId, toot.PostGuidHash, toot.TootedAt, toot.StatusId, toot.Content)
 	if err != nil {
@@ -243,8 +286,22 @@ func (repo *Repo) AddToot(accountId int, toot *Toot) error {
 	return nil
 }
 
+func (repo *Repo) GetToot(user string, id int) (*Toot, error) {
+	row := repo.queryRow(`SELECT post_guid_hash, tooted_at, status_id, content FROM toots
+		JOIN accounts ON toots.account_id=accounts.id AND accounts.handle=?
+		WHERE toots.id=?`, user, id)
+	var t Toot
+	if err := row.Scan(&t.PostGuidHash, &t.TootedAt, &t.StatusId, &t.Content); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
 func (repo *Repo) GetFollowerCount(user string) (uint, error) {
-	row := repo.db.QueryRow(`SELECT COUNT(*) FROM followers JOIN accounts
+	row := repo.queryRow(`SELECT COUNT(*) FROM followers JOIN accounts
 		ON followers.account_id=accounts.id AND accounts.handle=?`, user)
 	var err error
 	var count int
@@ -255,7 +312,7 @@ func (repo *Repo) GetFollowerCount(user string) (uint, error) {
 }
 
 func (repo *Repo) GetFollowersByUser(user string) ([]*MastodonUserInfo, error) {
-	rows, err := repo.db.Query(`SELECT followers.user_url, followers.handle, host, shared_inbox
+	rows, err := repo.query(`SELECT followers.user_url, followers.handle, host, shared_inbox
 		FROM followers JOIN accounts ON followers.account_id=accounts.id AND accounts.handle=?`, user)
 	if err != nil {
 		return nil, err
@@ -265,7 +322,7 @@ func (repo *Repo) GetFollowersByUser(user string) ([]*MastodonUserInfo, error) {
 }
 
 func (repo *Repo) GetFollowersById(accountId int) ([]*MastodonUserInfo, error) {
-	rows, err := repo.db.Query(`SELECT user_url, handle, host, shared_inbox
+	rows, err := repo.query(`SELECT user_url, handle, host, shared_inbox
 		FROM followers WHERE account_id=?`, accountId)
 	if err != nil {
 		return nil, err
@@ -291,13 +348,13 @@ func readGetFollowers(rows *sql.Rows) ([]*MastodonUserInfo, error) {
 }
 
 func (repo *Repo) AddFollower(user string, follower *MastodonUserInfo) error {
-	row := repo.db.QueryRow(`SELECT id FROM accounts WHERE handle=?`, user)
+	row := repo.queryRow(`SELECT id FROM accounts WHERE handle=?`, user)
 	var err error
 	var accountId int
 	if err = row.Scan(&accountId); err != nil {
 		return err
 	}
-	_, err = repo.db.Exec(`INSERT INTO followers VALUES(?, ?, ?, ?, ?)`,
+	_, err = repo.exec(`INSERT INTO followers VALUES(?, ?, ?, ?, ?)`,
 		accountId, follower.UserUrl, follower.Handle, follower.Host, follower.SharedInbox)
 	if err != nil {
 		return err
@@ -306,13 +363,13 @@ func (repo *Repo) AddFollower(user string, follower *MastodonUserInfo) error {
 }
 
 func (repo *Repo) RemoveFollower(user, followerUserUrl string) error {
-	row := repo.db.QueryRow(`SELECT id FROM accounts WHERE handle=?`, user)
+	row := repo.queryRow(`SELECT id FROM accounts WHERE handle=?`, user)
 	var err error
 	var accountId int
 	if err = row.Scan(&accountId); err != nil {
 		return err
 	}
-	_, err = repo.db.Exec(`DELETE FROM followers WHERE account_id=? AND user_url=?`,
+	_, err = repo.exec(`DELETE FROM followers WHERE account_id=? AND user_url=?`,
 		accountId, followerUserUrl)
 	if err != nil {
 		return err
@@ -323,7 +380,7 @@ func (repo *Repo) RemoveFollower(user, followerUserUrl string) error {
 func (repo *Repo) GetFeedLastUpdated(accountId int) (res time.Time, err error) {
 	res = time.Time{}
 	err = nil
-	row := repo.db.QueryRow("SELECT feed_last_updated FROM accounts WHERE id=?", accountId)
+	row := repo.queryRow("SELECT feed_last_updated FROM accounts WHERE id=?", accountId)
 	if err = row.Scan(&res); err != nil {
 		return
 	}
@@ -331,13 +388,13 @@ func (repo *Repo) GetFeedLastUpdated(accountId int) (res time.Time, err error) {
 }
 
 func (repo *Repo) UpdateAccountFeedTimes(accountId int, lastUpdated, nextCheckDue time.Time) error {
-	_, err := repo.db.Exec(`UPDATE accounts SET feed_last_updated=?, next_check_due=?
+	_, err := repo.exec(`UPDATE accounts SET feed_last_updated=?, next_check_due=?
         WHERE id=?`, lastUpdated, nextCheckDue, accountId)
 	return err
 }
 
 func (repo *Repo) GetAccountToCheck(checkDue time.Time) (*Account, error) {
-	rows, err := repo.db.Query(`SELECT id, created_at, user_url, handle, name, summary, profile_image_url,
+	rows, err := repo.query(`SELECT id, created_at, user_url, handle, name, summary, profile_image_url,
     	site_url, feed_url, feed_last_updated, next_check_due, pubkey
 		FROM accounts WHERE next_check_due<? LIMIT 1`, checkDue)
 	if err != nil {
@@ -362,7 +419,7 @@ func (repo *Repo) AddFeedPostIfNew(accountId int, post *FeedPost) (isNew bool, e
 
 	err = nil
 
-	_, err = repo.db.Exec(`INSERT INTO feed_posts
+	_, err = repo.exec(`INSERT INTO feed_posts
     	(account_id, post_guid_hash, post_time, link, title, description)
 		VALUES (?, ?, ?, ?, ?, ?)`,
 		accountId, post.PostGuidHash, post.PostTime, post.Link, post.Title, post.Desription)
@@ -373,48 +430,19 @@ func (repo *Repo) AddFeedPostIfNew(accountId int, post *FeedPost) (isNew bool, e
 	}
 
 	// Duplicate key: feed post for this account+guid_hash already exists
-	if sqliteErr, ok := err.(*sqlite3.Error); ok {
-		// Duplicate key: account with this handle already exists
-		if sqliteErr.Code == 19 && sqliteErr.ExtendedCode == 2067 {
-			isNew = false
-			err = nil
-			return
-		}
+	if repo.dialect.isDuplicateKey(err) {
+		isNew = false
+		err = nil
+		return
 	}
 
 	return
 }
 
 func (repo *Repo) AddTootQueueItem(tqi *TootQueueItem) error {
-	_, err := repo.db.Exec(`INSERT INTO toot_queue (sending_user, to_inbox, tooted_at, status_id, content)
-		VALUES(?, ?, ?, ?, ?)`,
-		tqi.SendingUser, tqi.ToInbox, tqi.TootedAt, tqi.StatusId, tqi.Content)
-	return err
-}
-
-func (repo *Repo) GetTootQueueItems(aboveId, maxCount int) ([]*TootQueueItem, error) {
-	rows, err := repo.db.Query(`SELECT id, sending_user, to_inbox, tooted_at, status_id, content
-		FROM toot_queue WHERE id>? ORDER BY id ASC LIMIT ?`, aboveId, maxCount)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	res := make([]*TootQueueItem, 0, maxCount)
-	for rows.Next() {
-		tqi := TootQueueItem{}
-		err = rows.Scan(&tqi.Id, &tqi.SendingUser, &tqi.ToInbox, &tqi.TootedAt, &tqi.StatusId, &tqi.Content)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, &tqi)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	return res, nil
-}
-
-func (repo *Repo) DeleteTootQueueItem(id int) error {
-	_, err := repo.db.Exec(`DELETE FROM toot_queue WHERE id=?`, id)
+	_, err := repo.exec(`INSERT INTO toot_queue
+    	(sending_user, to_inbox, tooted_at, status_id, content, attempts, next_attempt_at)
+		VALUES(?, ?, ?, ?, ?, 0, ?)`,
+		tqi.SendingUser, tqi.ToInbox, tqi.TootedAt, tqi.StatusId, tqi.Content, time.Now())
 	return err
 }
@@ -0,0 +1,380 @@
+package dal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"rss_parrot/shared"
+)
+
+const (
+	tootQueueLeaseDuration  = 5 * time.Minute
+	tootDeliveryMaxAttempts = 10
+	tootDeliveryMaxAge      = 72 * time.Hour
+	tootDeliveryBackoffBase = 30 * time.Second
+	tootDeliveryBackoffCap  = 1 * time.Hour
+
+	// instanceCircuitBreakThreshold is the number of consecutive failures
+	// after which an instance's queue items stop being leased at all, save
+	// for one probe per instanceCircuitBreakCooldown.
+	instanceCircuitBreakThreshold = 5
+	instanceCircuitBreakCooldown  = 15 * time.Minute
+)
+
+// InstanceHealth tracks a remote instance's recent delivery failure streak,
+// so the scheduler can circuit-break an instance that's down entirely
+// instead of hammering it once per queued toot.
+type InstanceHealth struct {
+	Host                string
+	FailingSince        time.Time
+	ConsecutiveFailures int
+}
+
+// LeaseTootQueueItems returns up to maxCount items due for (re-)delivery
+// that aren't currently leased by another worker, and marks them leased so
+// concurrent sender goroutines don't double-send. A lease expires on its
+// own after tootQueueLeaseDuration, so a worker that dies mid-delivery
+// doesn't strand its items forever.
+//
+// Items bound for a host whose circuit breaker is open (instanceCircuitBreakThreshold
+// consecutive failures) are skipped entirely, except for a single probe per
+// instanceCircuitBreakCooldown, so a dead instance doesn't keep every one of
+// its queued items cycling through backoff in lockstep.
+func (repo *Repo) LeaseTootQueueItems(now time.Time, maxCount int) ([]*TootQueueItem, error) {
+
+	rows, err := repo.query(`SELECT id, to_inbox FROM toot_queue
+		WHERE next_attempt_at<=? AND (leased_until IS NULL OR leased_until<?)
+		ORDER BY id ASC LIMIT ?`, now, now, maxCount*4)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		id      int
+		toInbox string
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err = rows.Scan(&c.id, &c.toInbox); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+	if len(candidates) == 0 {
+		return []*TootQueueItem{}, nil
+	}
+
+	var ids []int
+	probedHosts := map[string]bool{}
+	for _, c := range candidates {
+		if len(ids) >= maxCount {
+			break
+		}
+		host, hErr := shared.GetHostName(c.toInbox)
+		if hErr != nil {
+			host = c.toInbox
+		}
+		state, cbErr := repo.circuitState(host, now)
+		if cbErr != nil {
+			return nil, cbErr
+		}
+		switch state {
+		case circuitOpenBlocked:
+			continue
+		case circuitOpenProbe:
+			if probedHosts[host] {
+				continue
+			}
+			probedHosts[host] = true
+		}
+		ids = append(ids, c.id)
+	}
+	if len(ids) == 0 {
+		return []*TootQueueItem{}, nil
+	}
+
+	// The UPDATE re-checks the same lease condition the candidate SELECT
+	// used, so a row already claimed by a concurrent LeaseTootQueueItems call
+	// (which will have moved leased_until into the future) is excluded here
+	// even though it was still unleased when we read the candidate list
+	// above. The follow-up SELECT filters on leased_until=leaseUntil, so it
+	// only returns the rows *this* call actually won the lease on.
+	placeholders, idArgs := idInClause(ids)
+	leaseUntil := now.Add(tootQueueLeaseDuration)
+	updateArgs := append([]any{leaseUntil}, idArgs...)
+	updateArgs = append(updateArgs, now)
+	if _, err = repo.exec(fmt.Sprintf(
+		`UPDATE toot_queue SET leased_until=? WHERE id IN (%s) AND (leased_until IS NULL OR leased_until<?)`,
+		placeholders), updateArgs...); err != nil {
+		return nil, err
+	}
+
+	selArgs := append([]any{leaseUntil}, idArgs...)
+	selRows, err := repo.query(fmt.Sprintf(`SELECT id, sending_user, to_inbox, tooted_at, status_id, content,
+		attempts, next_attempt_at, last_error FROM toot_queue WHERE leased_until=? AND id IN (%s) ORDER BY id ASC`,
+		placeholders), selArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer selRows.Close()
+
+	res := make([]*TootQueueItem, 0, len(ids))
+	for selRows.Next() {
+		tqi := TootQueueItem{}
+		var lastError sql.NullString
+		if err = selRows.Scan(&tqi.Id, &tqi.SendingUser, &tqi.ToInbox, &tqi.TootedAt, &tqi.StatusId, &tqi.Content,
+			&tqi.Attempts, &tqi.NextAttemptAt, &lastError); err != nil {
+			return nil, err
+		}
+		tqi.LastError = lastError.String
+		res = append(res, &tqi)
+	}
+	if err = selRows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListTootQueueItems returns up to maxCount queue items in id order, without
+// leasing them. Meant for operator inspection (`rss-parrot queue inspect`),
+// not for driving delivery.
+func (repo *Repo) ListTootQueueItems(maxCount int) ([]*TootQueueItem, error) {
+	rows, err := repo.query(`SELECT id, sending_user, to_inbox, tooted_at, status_id, content,
+		attempts, next_attempt_at, last_error FROM toot_queue ORDER BY id ASC LIMIT ?`, maxCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*TootQueueItem, 0, maxCount)
+	for rows.Next() {
+		tqi := TootQueueItem{}
+		var lastError sql.NullString
+		if err = rows.Scan(&tqi.Id, &tqi.SendingUser, &tqi.ToInbox, &tqi.TootedAt, &tqi.StatusId, &tqi.Content,
+			&tqi.Attempts, &tqi.NextAttemptAt, &lastError); err != nil {
+			return nil, err
+		}
+		tqi.LastError = lastError.String
+		res = append(res, &tqi)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RequeueTootQueueItem clears an item's lease and makes it due immediately,
+// regardless of its current backoff. Used by `rss-parrot queue requeue`.
+func (repo *Repo) RequeueTootQueueItem(id int) error {
+	_, err := repo.exec(`UPDATE toot_queue SET next_attempt_at=?, leased_until=NULL WHERE id=?`, time.Now(), id)
+	return err
+}
+
+// MarkTootDeliveryOk removes a successfully-delivered item from the queue.
+// This replaces the old DeleteTootQueueItem now that the queue also needs
+// to record failed attempts.
+func (repo *Repo) MarkTootDeliveryOk(id int) error {
+	_, err := repo.exec(`DELETE FROM toot_queue WHERE id=?`, id)
+	return err
+}
+
+// DrainTootQueue forcibly empties the entire queue, bypassing next_attempt_at
+// backoff and the instance circuit breaker entirely (unlike
+// LeaseTootQueueItems, which deliberately respects both). Meant for
+// `rss-parrot queue drain` when decommissioning an instance or a dead
+// recipient, not as a substitute for letting the live delivery worker retry
+// in the background.
+func (repo *Repo) DrainTootQueue() (int64, error) {
+	res, err := repo.exec(`DELETE FROM toot_queue`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// MarkTootDeliveryFailed records a failed delivery attempt and schedules the
+// next one with exponential backoff (plus jitter, so a pile of items for the
+// same down instance don't all retry in lockstep). Once an item has failed
+// tootDeliveryMaxAttempts times, or has been failing for longer than
+// tootDeliveryMaxAge, it is moved to toot_dead_letter instead of being
+// retried again.
+func (repo *Repo) MarkTootDeliveryFailed(id int, deliveryErr error) error {
+
+	row := repo.queryRow(`SELECT to_inbox, attempts, first_failed_at FROM toot_queue WHERE id=?`, id)
+	var toInbox string
+	var attempts int
+	var firstFailedAt sql.NullTime
+	if err := row.Scan(&toInbox, &attempts, &firstFailedAt); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	attempts++
+	since := now
+	if firstFailedAt.Valid {
+		since = firstFailedAt.Time
+	}
+
+	host, err := shared.GetHostName(toInbox)
+	if err != nil {
+		host = toInbox
+	}
+	if err = repo.recordInstanceFailure(host); err != nil {
+		return err
+	}
+
+	if attempts >= tootDeliveryMaxAttempts || now.Sub(since) >= tootDeliveryMaxAge {
+		return repo.moveToDeadLetter(id, deliveryErr.Error())
+	}
+
+	_, err = repo.exec(`UPDATE toot_queue
+		SET attempts=?, next_attempt_at=?, last_error=?, first_failed_at=?, leased_until=NULL
+		WHERE id=?`, attempts, now.Add(backoffWithJitter(attempts)), deliveryErr.Error(), since, id)
+	return err
+}
+
+func (repo *Repo) moveToDeadLetter(id int, reason string) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(repo.dialect.rewrite(`INSERT INTO toot_dead_letter
+		(sending_user, to_inbox, tooted_at, status_id, content, attempts, last_error, dead_lettered_at)
+		SELECT sending_user, to_inbox, tooted_at, status_id, content, attempts, ?, ?
+		FROM toot_queue WHERE id=?`), reason, time.Now(), id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(repo.dialect.rewrite(`DELETE FROM toot_queue WHERE id=?`), id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// backoffWithJitter returns base*2^attempts, capped at tootDeliveryBackoffCap,
+// plus up to 20% random jitter.
+func backoffWithJitter(attempts int) time.Duration {
+	shift := attempts
+	if shift > 16 {
+		shift = 16 // plenty past the cap; keeps the shift from overflowing
+	}
+	backoff := tootDeliveryBackoffBase << uint(shift)
+	if backoff <= 0 || backoff > tootDeliveryBackoffCap {
+		backoff = tootDeliveryBackoffCap
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff)/5 + 1))
+	return backoff + jitter
+}
+
+func (repo *Repo) recordInstanceFailure(host string) error {
+	_, err := repo.exec(`INSERT INTO instance_health (host, failing_since, consecutive_failures)
+		VALUES(?, ?, 1)`, host, time.Now())
+	if err == nil {
+		return nil
+	}
+	if !repo.dialect.isDuplicateKey(err) {
+		return err
+	}
+	_, err = repo.exec(`UPDATE instance_health SET consecutive_failures=consecutive_failures+1
+		WHERE host=?`, host)
+	return err
+}
+
+// circuitState classifies how LeaseTootQueueItems should treat a host's
+// queued items this round.
+type circuitState int
+
+const (
+	// circuitClosed: host hasn't failed enough in a row to be broken; lease
+	// its items normally.
+	circuitClosed circuitState = iota
+	// circuitOpenProbe: host is circuit-broken, but instanceCircuitBreakCooldown
+	// has elapsed since the last probe, so exactly one item should be let
+	// through to test whether it has recovered.
+	circuitOpenProbe
+	// circuitOpenBlocked: host is circuit-broken and still within its
+	// cooldown window; lease nothing for it.
+	circuitOpenBlocked
+)
+
+// circuitState reports how host's circuit breaker should be treated right
+// now. Once a host has failed instanceCircuitBreakThreshold times in a row,
+// it's circuitOpenBlocked until instanceCircuitBreakCooldown has passed since
+// the last probe, at which point exactly one call gets circuitOpenProbe (the
+// UPDATE that grants it is itself conditioned on the cooldown, so concurrent
+// callers can't both win the same probe).
+func (repo *Repo) circuitState(host string, now time.Time) (circuitState, error) {
+	row := repo.queryRow(`SELECT consecutive_failures, last_attempt_at FROM instance_health WHERE host=?`, host)
+	var failures int
+	var lastAttempt sql.NullTime
+	if err := row.Scan(&failures, &lastAttempt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return circuitClosed, nil
+		}
+		return circuitClosed, err
+	}
+	if failures < instanceCircuitBreakThreshold {
+		return circuitClosed, nil
+	}
+	if lastAttempt.Valid && now.Sub(lastAttempt.Time) < instanceCircuitBreakCooldown {
+		return circuitOpenBlocked, nil
+	}
+
+	cooldownEdge := now.Add(-instanceCircuitBreakCooldown)
+	res, err := repo.exec(`UPDATE instance_health SET last_attempt_at=? WHERE host=?
+		AND (last_attempt_at IS NULL OR last_attempt_at<?)`, now, host, cooldownEdge)
+	if err != nil {
+		return circuitOpenBlocked, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return circuitOpenBlocked, err
+	}
+	if n == 0 {
+		// A concurrent caller already claimed this round's probe.
+		return circuitOpenBlocked, nil
+	}
+	return circuitOpenProbe, nil
+}
+
+// RecordInstanceSuccess clears an instance's recorded failure streak after a
+// delivery to it succeeds.
+func (repo *Repo) RecordInstanceSuccess(host string) error {
+	_, err := repo.exec(`DELETE FROM instance_health WHERE host=?`, host)
+	return err
+}
+
+// GetInstanceHealth reports an instance's current failure streak, or nil if
+// it has none on record (i.e. it's healthy, or has never been tried).
+func (repo *Repo) GetInstanceHealth(host string) (*InstanceHealth, error) {
+	row := repo.queryRow(`SELECT failing_since, consecutive_failures FROM instance_health WHERE host=?`, host)
+	res := InstanceHealth{Host: host}
+	if err := row.Scan(&res.FailingSince, &res.ConsecutiveFailures); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &res, nil
+}
+
+func idInClause(ids []int) (string, []any) {
+	placeholders := make([]string, len(ids))
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(placeholders, ","), args
+}
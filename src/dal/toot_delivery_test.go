@@ -0,0 +1,256 @@
+//go:build !nosqlite
+
+package dal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMigratedTestRepo(t *testing.T) *Repo {
+	t.Helper()
+	repo := newTestRepo(t)
+	if err := repo.Migrate(-1); err != nil {
+		t.Fatalf("Migrate(-1) failed: %v", err)
+	}
+	return repo
+}
+
+func addQueueItem(t *testing.T, repo *Repo, toInbox string) {
+	t.Helper()
+	if err := repo.AddTootQueueItem(&TootQueueItem{
+		SendingUser: "birb",
+		ToInbox:     toInbox,
+		TootedAt:    time.Now(),
+		StatusId:    "1",
+		Content:     "hello",
+	}); err != nil {
+		t.Fatalf("AddTootQueueItem failed: %v", err)
+	}
+}
+
+// TestLeaseTootQueueItemsIsExclusiveUnderConcurrency exercises the fix for
+// the lease race: several goroutines hammering LeaseTootQueueItems
+// concurrently must never be handed the same row twice.
+func TestLeaseTootQueueItemsIsExclusiveUnderConcurrency(t *testing.T) {
+	repo := newMigratedTestRepo(t)
+
+	const nItems = 30
+	for i := 0; i < nItems; i++ {
+		addQueueItem(t, repo, fmt.Sprintf("https://inbox%d.example.com/inbox", i))
+	}
+
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	var wg sync.WaitGroup
+	const nWorkers = 8
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				items, err := repo.LeaseTootQueueItems(time.Now(), 1)
+				if err != nil {
+					t.Errorf("LeaseTootQueueItems failed: %v", err)
+					return
+				}
+				if len(items) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, it := range items {
+					if seen[it.Id] {
+						t.Errorf("item %d was leased by more than one caller", it.Id)
+					}
+					seen[it.Id] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != nItems {
+		t.Errorf("expected all %d items to be leased exactly once, got %d", nItems, len(seen))
+	}
+}
+
+// TestMarkTootDeliveryFailedDeadLettersAfterMaxAttempts drives a single item
+// through repeated failures and checks it ends up in toot_dead_letter rather
+// than retrying forever.
+func TestMarkTootDeliveryFailedDeadLettersAfterMaxAttempts(t *testing.T) {
+	repo := newMigratedTestRepo(t)
+	addQueueItem(t, repo, "https://dead.example.com/inbox")
+
+	items, err := repo.LeaseTootQueueItems(time.Now(), 1)
+	if err != nil {
+		t.Fatalf("LeaseTootQueueItems failed: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected to lease 1 item, got %d", len(items))
+	}
+	id := items[0].Id
+
+	for i := 0; i < tootDeliveryMaxAttempts; i++ {
+		if err = repo.MarkTootDeliveryFailed(id, errors.New("delivery failed")); err != nil {
+			t.Fatalf("MarkTootDeliveryFailed attempt %d failed: %v", i+1, err)
+		}
+	}
+
+	row := repo.db.QueryRow(`SELECT COUNT(*) FROM toot_queue WHERE id=?`, id)
+	var remaining int
+	if err = row.Scan(&remaining); err != nil {
+		t.Fatalf("failed to count toot_queue: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("expected the item to have left toot_queue after %d failures, but it's still there",
+			tootDeliveryMaxAttempts)
+	}
+
+	row = repo.db.QueryRow(`SELECT COUNT(*) FROM toot_dead_letter WHERE to_inbox=?`, "https://dead.example.com/inbox")
+	var deadLettered int
+	if err = row.Scan(&deadLettered); err != nil {
+		t.Fatalf("failed to count toot_dead_letter: %v", err)
+	}
+	if deadLettered != 1 {
+		t.Errorf("expected exactly 1 dead-lettered row, got %d", deadLettered)
+	}
+}
+
+// TestCircuitBreakerBlocksThenProbesAfterCooldown exercises the fix for the
+// cooldown bug: a freshly broken host gets one probe right away, then its
+// items must stay blocked until the cooldown has actually elapsed, and then
+// exactly one more probe should go through.
+func TestCircuitBreakerBlocksThenProbesAfterCooldown(t *testing.T) {
+	repo := newMigratedTestRepo(t)
+	const host = "broken.example.com"
+	toInbox := "https://" + host + "/inbox"
+
+	now := time.Now()
+	for i := 0; i < instanceCircuitBreakThreshold; i++ {
+		if err := repo.recordInstanceFailure(host); err != nil {
+			t.Fatalf("recordInstanceFailure failed: %v", err)
+		}
+	}
+
+	state, err := repo.circuitState(host, now)
+	if err != nil {
+		t.Fatalf("circuitState failed: %v", err)
+	}
+	if state != circuitOpenProbe {
+		t.Fatalf("expected a fresh breaker trip to grant an immediate probe, got %v", state)
+	}
+
+	// Immediately afterwards, with no cooldown elapsed, the breaker must stay
+	// blocked rather than handing out another probe.
+	state, err = repo.circuitState(host, now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("circuitState failed: %v", err)
+	}
+	if state != circuitOpenBlocked {
+		t.Errorf("expected circuitOpenBlocked within the cooldown window, got %v", state)
+	}
+
+	// Once the cooldown has elapsed, exactly one more probe should be granted.
+	later := now.Add(instanceCircuitBreakCooldown + time.Minute)
+	state, err = repo.circuitState(host, later)
+	if err != nil {
+		t.Fatalf("circuitState failed: %v", err)
+	}
+	if state != circuitOpenProbe {
+		t.Errorf("expected circuitOpenProbe once the cooldown has elapsed, got %v", state)
+	}
+	state, err = repo.circuitState(host, later.Add(time.Second))
+	if err != nil {
+		t.Fatalf("circuitState failed: %v", err)
+	}
+	if state != circuitOpenBlocked {
+		t.Errorf("expected only a single probe per cooldown window, got %v", state)
+	}
+
+	// LeaseTootQueueItems must honor the same state: blocked items aren't
+	// returned at all.
+	addQueueItem(t, repo, toInbox)
+	items, err := repo.LeaseTootQueueItems(now.Add(2*time.Second), 10)
+	if err != nil {
+		t.Fatalf("LeaseTootQueueItems failed: %v", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("expected a circuit-broken host's items to be skipped, got %d", len(items))
+	}
+}
+
+// TestRecordInstanceSuccessClearsHealth verifies that a successful delivery
+// resets a host's failure streak so it isn't left circuit-broken forever.
+func TestRecordInstanceSuccessClearsHealth(t *testing.T) {
+	repo := newMigratedTestRepo(t)
+	const host = "recovers.example.com"
+
+	for i := 0; i < instanceCircuitBreakThreshold; i++ {
+		if err := repo.recordInstanceFailure(host); err != nil {
+			t.Fatalf("recordInstanceFailure failed: %v", err)
+		}
+	}
+	health, err := repo.GetInstanceHealth(host)
+	if err != nil {
+		t.Fatalf("GetInstanceHealth failed: %v", err)
+	}
+	if health == nil || health.ConsecutiveFailures != instanceCircuitBreakThreshold {
+		t.Fatalf("expected %d recorded failures, got %+v", instanceCircuitBreakThreshold, health)
+	}
+
+	if err = repo.RecordInstanceSuccess(host); err != nil {
+		t.Fatalf("RecordInstanceSuccess failed: %v", err)
+	}
+	health, err = repo.GetInstanceHealth(host)
+	if err != nil {
+		t.Fatalf("GetInstanceHealth failed: %v", err)
+	}
+	if health != nil {
+		t.Errorf("expected no recorded health after a successful delivery, got %+v", health)
+	}
+}
+
+// TestDrainTootQueueIgnoresBackoffAndCircuitBreaker verifies DrainTootQueue's
+// guarantee that it empties the queue unconditionally, including items that
+// LeaseTootQueueItems would skip: one still in backoff, and one bound for a
+// circuit-broken host whose probe for this cooldown window is already used.
+func TestDrainTootQueueIgnoresBackoffAndCircuitBreaker(t *testing.T) {
+	repo := newMigratedTestRepo(t)
+	addQueueItem(t, repo, "https://future.example.com/inbox")
+
+	if _, err := repo.db.Exec(
+		`UPDATE toot_queue SET next_attempt_at=?`, time.Now().Add(24*time.Hour)); err != nil {
+		t.Fatalf("failed to push next_attempt_at into the future: %v", err)
+	}
+
+	const brokenHost = "broken.example.com"
+	for i := 0; i < instanceCircuitBreakThreshold; i++ {
+		if err := repo.recordInstanceFailure(brokenHost); err != nil {
+			t.Fatalf("recordInstanceFailure failed: %v", err)
+		}
+	}
+	if _, err := repo.circuitState(brokenHost, time.Now()); err != nil {
+		t.Fatalf("circuitState failed: %v", err)
+	}
+	addQueueItem(t, repo, "https://"+brokenHost+"/inbox")
+
+	items, err := repo.LeaseTootQueueItems(time.Now(), 10)
+	if err != nil {
+		t.Fatalf("LeaseTootQueueItems failed: %v", err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected the backoff-pending and circuit-broken items to be invisible to leasing, got %d", len(items))
+	}
+
+	n, err := repo.DrainTootQueue()
+	if err != nil {
+		t.Fatalf("DrainTootQueue failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected DrainTootQueue to remove both pending items regardless of backoff and circuit breaker, got %d", n)
+	}
+}
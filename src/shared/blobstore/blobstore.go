@@ -0,0 +1,42 @@
+// Package blobstore stores binary blobs (account avatars, feed icons) so
+// the ActivityPub Actor document can point at a URL rss-parrot controls
+// instead of the upstream URL, which may disappear.
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"rss_parrot/shared"
+)
+
+// IBlobStore puts and fetches blobs behind a stable key, and hands back the
+// URL stored content can be fetched from.
+type IBlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (url string, err error)
+	Get(ctx context.Context, key string) (r io.ReadCloser, contentType string, err error)
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+// New builds the IBlobStore selected by cfg.Type, the same way dal picks a
+// database dialect from DatabaseCfg.
+func New(ctx context.Context, cfg *shared.BlobStoreCfg) (IBlobStore, error) {
+	switch cfg.Type {
+	case "fs":
+		return NewFilesystemStore(cfg.FsDir, cfg.FsBaseUrl), nil
+	case "s3":
+		return NewS3Store(ctx, S3Config{
+			Region:       cfg.S3Region,
+			Bucket:       cfg.S3Bucket,
+			Endpoint:     cfg.S3Endpoint,
+			AccessKey:    cfg.S3AccessKey,
+			SecretKey:    cfg.S3SecretKey,
+			UsePathStyle: cfg.S3UsePathStyle,
+			BaseUrl:      cfg.S3BaseUrl,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported blob store type '%s'", cfg.Type)
+	}
+}
@@ -0,0 +1,64 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FilesystemStore keeps blobs as plain files under a local directory, served
+// back out by the handler from NewMediaHandler. Meant for dev and
+// single-instance deployments; NewS3Store is the one to reach for once
+// rss-parrot runs on more than one box.
+type FilesystemStore struct {
+	dir     string
+	baseUrl string
+}
+
+func NewFilesystemStore(dir, baseUrl string) *FilesystemStore {
+	return &FilesystemStore{dir: dir, baseUrl: strings.TrimRight(baseUrl, "/")}
+}
+
+func (s *FilesystemStore) Put(_ context.Context, key string, r io.Reader, _ string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		return "", err
+	}
+	return s.URL(key), nil
+}
+
+func (s *FilesystemStore) Get(_ context.Context, key string) (io.ReadCloser, string, error) {
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, "", err
+	}
+	return f, "", nil
+}
+
+func (s *FilesystemStore) Delete(_ context.Context, key string) error {
+	return os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+func (s *FilesystemStore) URL(key string) string {
+	return fmt.Sprintf("%s/%s", s.baseUrl, key)
+}
+
+// NewMediaHandler serves a FilesystemStore's blobs straight off disk. It
+// strips a fixed "/media/" prefix, so it must be mounted at "/media/" and the
+// store's base URL must point at that path.
+// S3Store doesn't need this: its URL() already points straight at the bucket.
+func NewMediaHandler(store *FilesystemStore) http.Handler {
+	return http.StripPrefix("/media/", http.FileServer(http.Dir(store.dir)))
+}
@@ -0,0 +1,18 @@
+package shared
+
+// BlobStoreCfg selects and configures the blob store account avatars and
+// feed icons are persisted through. Type picks the backend ("fs" or "s3");
+// the rest of the fields are only meaningful for the backend they're named
+// after.
+type BlobStoreCfg struct {
+	Type           string
+	FsDir          string
+	FsBaseUrl      string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3UsePathStyle bool
+	S3BaseUrl      string
+}
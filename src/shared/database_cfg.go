@@ -0,0 +1,14 @@
+package shared
+
+// DatabaseCfg selects and configures the database backend dal connects to.
+// Type picks the driver ("sqlite3", "postgres" or "mysql"); FileName is only
+// meaningful for sqlite3, the rest only for postgres/mysql.
+type DatabaseCfg struct {
+	Type     string
+	FileName string
+	User     string
+	Password string
+	Database string
+	Host     string
+	Port     int
+}
@@ -38,6 +38,10 @@ func (idb *IdBuilder) UserUrl(user string) string {
 	return fmt.Sprintf("https://%s/u/%s", idb.Host, user)
 }
 
+func (idb *IdBuilder) UserAvatar(user string) string {
+	return fmt.Sprintf("https://%s/u/%s/avatar", idb.Host, user)
+}
+
 func (idb *IdBuilder) UserKeyId(user string) string {
 	return fmt.Sprintf("https://%s/u/%s#main-key", idb.Host, user)
 }